@@ -0,0 +1,194 @@
+package autodelete
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// Broker is the persistence layer behind a reapQueue: it tracks which
+// channel ID is due for its next reap/backlog-load pass and when, so the
+// schedule can survive a bot restart instead of forcing every channel to
+// reload its backlog from scratch to rediscover its next deletion time.
+type Broker interface {
+	// Enqueue schedules chID to become due at nextReap, replacing any
+	// existing schedule for it.
+	Enqueue(chID string, nextReap time.Time) error
+
+	// Dequeue blocks until a channel is due, moves it into a "processing"
+	// state, and returns its ID. It returns ctx.Err() if ctx is done
+	// first.
+	Dequeue(ctx context.Context) (chID string, err error)
+
+	// Ack clears chID's processing state once its work item has been
+	// handled. The worker is responsible for re-Enqueue-ing chID if it
+	// needs another pass.
+	Ack(chID string) error
+
+	// Snapshot returns every chID currently scheduled (not processing),
+	// keyed to its due time, for diagnostics and pool-depth accounting.
+	Snapshot() (map[string]time.Time, error)
+}
+
+// brokerCloser is implemented by Brokers that own background goroutines
+// needing to be stopped on shutdown, e.g. redisBroker's stale-claim
+// recovery loop and memoryBroker's timer watcher.
+type brokerCloser interface {
+	Close() error
+}
+
+type brokerItem struct {
+	chID     string
+	nextReap time.Time
+	index    int
+}
+
+type brokerHeap []*brokerItem
+
+func (h brokerHeap) Len() int            { return len(h) }
+func (h brokerHeap) Less(i, j int) bool  { return h[i].nextReap.Before(h[j].nextReap) }
+func (h brokerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *brokerHeap) Push(x interface{}) {
+	item := x.(*brokerItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *brokerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	item.index = -1
+	*h = old[:n-1]
+	return item
+}
+
+// memoryBroker is the original in-process reap schedule: a priority queue
+// guarded by a condition variable. It's the default Broker and doesn't
+// survive a restart -- use a redisBroker for that.
+type memoryBroker struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	items      brokerHeap
+	byID       map[string]*brokerItem
+	processing map[string]struct{}
+	timer      *time.Timer
+
+	// done is closed by Close to stop the timer-watcher goroutine below.
+	done chan struct{}
+}
+
+func newMemoryBroker() *memoryBroker {
+	b := &memoryBroker{
+		byID:       make(map[string]*brokerItem),
+		processing: make(map[string]struct{}),
+		timer:      time.NewTimer(0),
+		done:       make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	heap.Init(&b.items)
+
+	go func() {
+		// Signal the condition variable every time the timer expires.
+		for {
+			select {
+			case <-b.timer.C:
+				b.mu.Lock()
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+
+	return b
+}
+
+// Close stops b's timer-watcher goroutine. It doesn't wake any blocked
+// Dequeue call; that's the caller's job via ctx, same as redisBroker.
+func (b *memoryBroker) Close() error {
+	close(b.done)
+	return nil
+}
+
+func (b *memoryBroker) Enqueue(chID string, nextReap time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if item, ok := b.byID[chID]; ok {
+		item.nextReap = nextReap
+		heap.Fix(&b.items, item.index)
+	} else {
+		item := &brokerItem{chID: chID, nextReap: nextReap}
+		heap.Push(&b.items, item)
+		b.byID[chID] = item
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *memoryBroker) Dequeue(ctx context.Context) (string, error) {
+	// Wake b.cond when ctx is done so a blocked Dequeue can notice.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		if len(b.items) == 0 {
+			b.cond.Wait()
+			continue
+		}
+
+		next := b.items[0]
+		now := time.Now()
+		if next.nextReap.After(now) {
+			b.timer.Reset(next.nextReap.Sub(now) + 2*time.Millisecond)
+			b.cond.Wait()
+			continue
+		}
+
+		item := heap.Pop(&b.items).(*brokerItem)
+		delete(b.byID, item.chID)
+		b.processing[item.chID] = struct{}{}
+		return item.chID, nil
+	}
+}
+
+func (b *memoryBroker) Ack(chID string) error {
+	b.mu.Lock()
+	delete(b.processing, chID)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBroker) Snapshot() (map[string]time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make(map[string]time.Time, len(b.items))
+	for _, item := range b.items {
+		out[item.chID] = item.nextReap
+	}
+	return out, nil
+}
@@ -0,0 +1,170 @@
+package autodelete
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dequeueScript atomically pops the lowest-scored due member off the
+// schedule set that isn't already claimed in the processing hash, and
+// stamps it into that hash with its claim time, so a concurrent Dequeue --
+// from another bot instance sharing this broker -- can't also claim it.
+// Skipping already-claimed members also means an Enqueue/Update racing
+// against a live claim (e.g. a new message bumping a channel's reap time
+// while a worker is still mid-flight on it) can't hand out a second claim
+// for the same channel before the first is Ack'd. Returns nil if nothing
+// unclaimed is due yet.
+var dequeueScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+for _, member in ipairs(members) do
+	if redis.call('HEXISTS', KEYS[2], member) == 0 then
+		redis.call('ZREM', KEYS[1], member)
+		redis.call('HSET', KEYS[2], member, ARGV[1])
+		return member
+	end
+end
+return nil
+`)
+
+// redisBroker is a Broker backed by a Redis sorted set, so the reap
+// schedule survives a bot restart instead of forcing every channel to
+// reload its backlog to rediscover its next deletion time. It mirrors
+// asynq's rdb-backed processor: Dequeue atomically moves a due member from
+// the schedule set into a "processing" hash (score = claim time), and a
+// background sweep re-queues anything left there past VisibilityTimeout,
+// on the assumption that whatever worker claimed it has crashed.
+type redisBroker struct {
+	rdb    *redis.Client
+	prefix string
+	logger Logger
+
+	// VisibilityTimeout bounds how long a claimed channel may sit in the
+	// processing hash before recoverStale puts it back on the schedule.
+	VisibilityTimeout time.Duration
+
+	// PollInterval is how often Dequeue re-checks the schedule set while
+	// waiting for the next due member.
+	PollInterval time.Duration
+
+	// cancel stops recoverStaleLoop; done is closed once it has.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newRedisBroker(rdb *redis.Client, prefix string) *redisBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &redisBroker{
+		rdb:               rdb,
+		prefix:            prefix,
+		logger:            stdLogger{},
+		VisibilityTimeout: 5 * time.Minute,
+		PollInterval:      time.Second,
+		cancel:            cancel,
+		done:              make(chan struct{}),
+	}
+	go b.recoverStaleLoop(ctx)
+	return b
+}
+
+// Close stops b's background stale-claim recovery loop and waits for it to
+// exit. It doesn't close the underlying *redis.Client, which b doesn't own.
+func (b *redisBroker) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+func (b *redisBroker) scheduleKey() string   { return b.prefix + ":schedule" }
+func (b *redisBroker) processingKey() string { return b.prefix + ":processing" }
+
+func (b *redisBroker) Enqueue(chID string, nextReap time.Time) error {
+	ctx := context.Background()
+	return b.rdb.ZAdd(ctx, b.scheduleKey(), &redis.Z{Score: float64(nextReap.UnixNano()), Member: chID}).Err()
+}
+
+func (b *redisBroker) Dequeue(ctx context.Context) (string, error) {
+	ticker := time.NewTicker(b.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UnixNano()
+		res, err := dequeueScript.Run(ctx, b.rdb, []string{b.scheduleKey(), b.processingKey()}, now).Result()
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+		if chID, ok := res.(string); ok {
+			return chID, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *redisBroker) Ack(chID string) error {
+	return b.rdb.HDel(context.Background(), b.processingKey(), chID).Err()
+}
+
+func (b *redisBroker) Snapshot() (map[string]time.Time, error) {
+	ctx := context.Background()
+	entries, err := b.rdb.ZRangeWithScores(ctx, b.scheduleKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]time.Time, len(entries))
+	for _, e := range entries {
+		if member, ok := e.Member.(string); ok {
+			out[member] = time.Unix(0, int64(e.Score))
+		}
+	}
+	return out, nil
+}
+
+// recoverStaleLoop periodically re-queues anything that's been claimed in
+// the processing hash for longer than VisibilityTimeout.
+func (b *redisBroker) recoverStaleLoop(ctx context.Context) {
+	defer close(b.done)
+	ticker := time.NewTicker(b.VisibilityTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.recoverStale(ctx); err != nil {
+				b.logger.Errorf("[reap] redis broker: stale recovery failed: %v", err)
+			}
+		}
+	}
+}
+
+func (b *redisBroker) recoverStale(ctx context.Context) error {
+	entries, err := b.rdb.HGetAll(ctx, b.processingKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-b.VisibilityTimeout).UnixNano()
+	for chID, claimedAtStr := range entries {
+		claimedAt, err := strconv.ParseInt(claimedAtStr, 10, 64)
+		if err != nil || claimedAt > cutoff {
+			continue
+		}
+
+		pipe := b.rdb.TxPipeline()
+		pipe.HDel(ctx, b.processingKey(), chID)
+		pipe.ZAdd(ctx, b.scheduleKey(), &redis.Z{Score: float64(time.Now().UnixNano()), Member: chID})
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package autodelete
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestMemoryBrokerDequeueOrdersByDueTime(t *testing.T) {
+	b := newMemoryBroker()
+	now := time.Now()
+
+	if err := b.Enqueue("later", now.Add(50*time.Millisecond)); err != nil {
+		t.Fatalf("Enqueue(later): %v", err)
+	}
+	if err := b.Enqueue("sooner", now); err != nil {
+		t.Fatalf("Enqueue(sooner): %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue #1: %v", err)
+	}
+	if first != "sooner" {
+		t.Fatalf("Dequeue #1 = %q, want %q", first, "sooner")
+	}
+
+	second, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue #2: %v", err)
+	}
+	if second != "later" {
+		t.Fatalf("Dequeue #2 = %q, want %q", second, "later")
+	}
+}
+
+func TestMemoryBrokerEnqueueReplacesExistingSchedule(t *testing.T) {
+	b := newMemoryBroker()
+	now := time.Now()
+
+	if err := b.Enqueue("ch1", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Enqueue(far future): %v", err)
+	}
+	if err := b.Enqueue("ch1", now); err != nil {
+		t.Fatalf("Enqueue(now): %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	chID, err := b.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	if chID != "ch1" {
+		t.Fatalf("Dequeue = %q, want %q", chID, "ch1")
+	}
+
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if len(snap) != 0 {
+		t.Fatalf("Snapshot after Dequeue = %v, want empty (only one schedule entry existed)", snap)
+	}
+}
+
+func TestMemoryBrokerDequeueUnblocksOnContextCancel(t *testing.T) {
+	b := newMemoryBroker()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Dequeue(ctx)
+		done <- err
+	}()
+
+	// Give the goroutine a chance to start blocking on an empty schedule.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Dequeue returned %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dequeue did not unblock after context cancellation")
+	}
+}
+
+func TestMemoryBrokerAckClearsProcessingWithoutAffectingSnapshot(t *testing.T) {
+	b := newMemoryBroker()
+	if err := b.Enqueue("ch1", time.Now()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.Dequeue(ctx); err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+
+	before, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot before Ack: %v", err)
+	}
+
+	if err := b.Ack("ch1"); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	b.mu.Lock()
+	_, stillProcessing := b.processing["ch1"]
+	b.mu.Unlock()
+	if stillProcessing {
+		t.Fatal("ch1 still in processing set after Ack")
+	}
+
+	after, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot after Ack: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("Snapshot after Ack = %v, want it unchanged from %v", after, before)
+	}
+}
+
+func TestMemoryBrokerSnapshotExcludesProcessing(t *testing.T) {
+	b := newMemoryBroker()
+	now := time.Now()
+	if err := b.Enqueue("claimed", now); err != nil {
+		t.Fatalf("Enqueue(claimed): %v", err)
+	}
+	if err := b.Enqueue("pending", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Enqueue(pending): %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.Dequeue(ctx); err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if _, ok := snap["claimed"]; ok {
+		t.Fatal("Snapshot includes a chID that's already claimed/processing")
+	}
+	if _, ok := snap["pending"]; !ok {
+		t.Fatal("Snapshot is missing a chID that's still scheduled")
+	}
+}
+
+// TestMemoryBrokerCloseStopsTimerWatcher guards against the regression
+// where extracting memoryBroker out of newReapQueue dropped chunk0-1's fix
+// for its timer-watcher goroutine leak: Close must make it exit.
+func TestMemoryBrokerCloseStopsTimerWatcher(t *testing.T) {
+	b := newMemoryBroker()
+
+	done := make(chan error, 1)
+	go func() { done <- b.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return; timer-watcher goroutine leaked")
+	}
+}
+
+// TestRedisBrokerCloseStopsStaleRecoveryLoop exercises chunk0-6's fix
+// without a live Redis server: the client here is never dialed (go-redis
+// connects lazily), and the default VisibilityTimeout is long enough that
+// recoverStaleLoop's ticker won't fire during the test, so the only way
+// Close can return is by actually canceling the loop's context.
+func TestRedisBrokerCloseStopsStaleRecoveryLoop(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer rdb.Close()
+
+	b := newRedisBroker(rdb, "test")
+
+	done := make(chan error, 1)
+	go func() { done <- b.Close() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return; recoverStaleLoop leaked")
+	}
+}
+
+// fakeCloserBroker is a minimal Broker + brokerCloser used to verify that
+// reapQueue.Shutdown invokes a Broker's Close without needing a real
+// redisBroker or Redis server.
+type fakeCloserBroker struct {
+	closed chan struct{}
+}
+
+func newFakeCloserBroker() *fakeCloserBroker {
+	return &fakeCloserBroker{closed: make(chan struct{})}
+}
+
+func (f *fakeCloserBroker) Enqueue(chID string, nextReap time.Time) error { return nil }
+
+func (f *fakeCloserBroker) Dequeue(ctx context.Context) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (f *fakeCloserBroker) Ack(chID string) error { return nil }
+
+func (f *fakeCloserBroker) Snapshot() (map[string]time.Time, error) { return nil, nil }
+
+func (f *fakeCloserBroker) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestReapQueueShutdownClosesBroker(t *testing.T) {
+	broker := newFakeCloserBroker()
+	q := newReapQueueWithBroker(1, broker)
+
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Shutdown kicks off Close in its own goroutine rather than waiting on
+	// it, so give it a moment to run instead of checking synchronously.
+	select {
+	case <-broker.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not call the broker's Close")
+	}
+}
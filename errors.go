@@ -0,0 +1,69 @@
+package autodelete
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Logger is a minimal leveled logging interface so operators can plug in
+// zap, zerolog, or another structured logger without autodelete depending
+// on a particular logging library.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger is the default Logger, backed by fmt.Printf, used until an
+// operator wires in something else.
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { fmt.Printf(format+"\n", args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { fmt.Printf(format+"\n", args...) }
+func (stdLogger) Warnf(format string, args ...interface{})  { fmt.Printf(format+"\n", args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { fmt.Printf(format+"\n", args...) }
+
+// SetLogger overrides q's logger. Passing nil is a no-op.
+func (q *reapQueue) SetLogger(l Logger) {
+	if l != nil {
+		q.logger = l
+	}
+}
+
+// ErrorHandlerFunc is notified of errors encountered while processing work
+// for a channel. phase is one of "load", "reap", or "panic".
+type ErrorHandlerFunc func(ch *ManagedChannel, err error, phase string)
+
+// handleWorkerError forwards err to b.ErrorHandler, if one is set.
+func (b *Bot) handleWorkerError(ch *ManagedChannel, err error, phase string) {
+	if b.ErrorHandler != nil {
+		b.ErrorHandler(ch, err, phase)
+	}
+}
+
+// workerPanicError wraps a recovered panic so callers can tell a crashed
+// work item apart from an ordinary error returned by LoadBacklog/Reap.
+type workerPanicError struct {
+	phase string
+	value interface{}
+}
+
+func (e *workerPanicError) Error() string {
+	return fmt.Sprintf("panic in %s worker: %v", e.phase, e.value)
+}
+
+// withPanicRecovery runs fn, recovering any panic so a single malformed
+// channel or message can't crash the whole worker pool. A recovered panic
+// is logged with its stack trace, reported to b.ErrorHandler with phase
+// "panic", and returned as a *workerPanicError.
+func (b *Bot) withPanicRecovery(q *reapQueue, ch *ManagedChannel, phase string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			q.logger.Errorf("[reap] %s: panic in %s worker: %v\n%s", ch, phase, r, debug.Stack())
+			err = &workerPanicError{phase: phase, value: r}
+			b.handleWorkerError(ch, err, "panic")
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,93 @@
+package autodelete
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWithPanicRecoveryReturnsWorkerPanicError(t *testing.T) {
+	q := newReapQueue(1)
+	b := &Bot{}
+	ch := &ManagedChannel{}
+
+	err := b.withPanicRecovery(q, ch, "load", func() error {
+		panic("boom")
+	})
+
+	var panicErr *workerPanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("withPanicRecovery err = %v (%T), want *workerPanicError", err, err)
+	}
+	if panicErr.phase != "load" {
+		t.Fatalf("phase = %q, want %q", panicErr.phase, "load")
+	}
+	if panicErr.value != "boom" {
+		t.Fatalf("value = %v, want %q", panicErr.value, "boom")
+	}
+}
+
+func TestWithPanicRecoveryReportsToErrorHandler(t *testing.T) {
+	q := newReapQueue(1)
+	ch := &ManagedChannel{}
+
+	var gotErr error
+	var gotPhase string
+	b := &Bot{
+		ErrorHandler: func(c *ManagedChannel, err error, phase string) {
+			gotErr = err
+			gotPhase = phase
+		},
+	}
+
+	err := b.withPanicRecovery(q, ch, "reap", func() error {
+		panic("kaboom")
+	})
+
+	if gotErr != err {
+		t.Fatalf("ErrorHandler saw err = %v, want the same error withPanicRecovery returned (%v)", gotErr, err)
+	}
+	// withPanicRecovery always reports recovered panics with phase "panic",
+	// regardless of which phase ("load"/"reap") the panic happened in.
+	if gotPhase != "panic" {
+		t.Fatalf("ErrorHandler phase = %q, want %q", gotPhase, "panic")
+	}
+}
+
+func TestWithPanicRecoveryPassesThroughOrdinaryError(t *testing.T) {
+	q := newReapQueue(1)
+	ch := &ManagedChannel{}
+
+	var handlerCalled bool
+	b := &Bot{
+		ErrorHandler: func(c *ManagedChannel, err error, phase string) {
+			handlerCalled = true
+		},
+	}
+
+	want := errors.New("ordinary failure")
+	err := b.withPanicRecovery(q, ch, "load", func() error {
+		return want
+	})
+
+	if err != want {
+		t.Fatalf("withPanicRecovery err = %v, want %v", err, want)
+	}
+	if handlerCalled {
+		t.Fatal("ErrorHandler was called for a non-panic error")
+	}
+}
+
+func TestWithPanicRecoverySkipsNilErrorHandler(t *testing.T) {
+	q := newReapQueue(1)
+	b := &Bot{}
+	ch := &ManagedChannel{}
+
+	err := b.withPanicRecovery(q, ch, "load", func() error {
+		panic("no handler set")
+	})
+
+	var panicErr *workerPanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("withPanicRecovery err = %v (%T), want *workerPanicError", err, err)
+	}
+}
@@ -0,0 +1,210 @@
+package autodelete
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// depthPerWorkerThreshold is the backlog depth per worker above which
+	// the boss goroutine starts boosting the pool.
+	depthPerWorkerThreshold = 4
+)
+
+// BoostTimeout, IdleTimeout, and bossInterval are vars rather than consts
+// so tests can shrink them instead of waiting out the real thresholds.
+var (
+	// BoostTimeout is how long depth-per-worker must stay above
+	// depthPerWorkerThreshold before the boss adds a worker.
+	BoostTimeout = 5 * time.Second
+
+	// IdleTimeout is how long utilization must stay low before the boss
+	// shrinks a worker back out of the pool.
+	IdleTimeout = 30 * time.Second
+
+	// bossInterval is how often the boss goroutine re-evaluates pool size.
+	bossInterval = 1 * time.Second
+)
+
+// PoolStats is a point-in-time snapshot of a reapQueue's worker pool.
+type PoolStats struct {
+	NumberOfWorkers       int
+	NumberOfActiveWorkers int
+	QueueDepth            int
+}
+
+// PoolStats reports the current size of q's worker pool and its backlog
+// depth, including channels pinned to a worker via q.curWork.
+func (q *reapQueue) PoolStats() PoolStats {
+	q.poolMu.Lock()
+	stats := PoolStats{
+		NumberOfWorkers:       q.numberOfWorkers,
+		NumberOfActiveWorkers: q.numberOfActiveWorkers,
+	}
+	q.poolMu.Unlock()
+
+	var depth int
+	if scheduled, err := q.broker.Snapshot(); err != nil {
+		q.logger.Errorf("[reap] %p: broker snapshot failed: %v", q, err)
+	} else {
+		depth = len(scheduled)
+	}
+
+	q.curMu.Lock()
+	depth += len(q.curWork)
+	q.curMu.Unlock()
+
+	stats.QueueDepth = depth
+	return stats
+}
+
+func (q *reapQueue) workerStarted() {
+	q.poolMu.Lock()
+	q.numberOfWorkers++
+	q.poolMu.Unlock()
+	poolWorkers.Inc()
+}
+
+func (q *reapQueue) workerStopped() {
+	q.poolMu.Lock()
+	q.numberOfWorkers--
+	q.poolMu.Unlock()
+	poolWorkers.Dec()
+}
+
+func (q *reapQueue) workerActive() {
+	q.poolMu.Lock()
+	q.numberOfActiveWorkers++
+	q.poolMu.Unlock()
+	poolActiveWorkers.Inc()
+}
+
+func (q *reapQueue) workerIdle() {
+	q.poolMu.Lock()
+	q.numberOfActiveWorkers--
+	q.poolMu.Unlock()
+	poolActiveWorkers.Dec()
+}
+
+var (
+	poolWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "pool_workers",
+		Help:      "Current number of workers in a reap/backlog-load pool.",
+	})
+	poolActiveWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "pool_active_workers",
+		Help:      "Current number of pool workers processing a work item.",
+	})
+	poolBoosts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "pool_boosts_total",
+		Help:      "Number of times the boss goroutine added a worker due to sustained backlog pressure.",
+	})
+	poolShrinks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "pool_shrinks_total",
+		Help:      "Number of times the boss goroutine removed a worker due to sustained low utilization.",
+	})
+	poolZeroWorkerRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "pool_zero_worker_restarts_total",
+		Help:      "Number of times the boss restarted a pool that had backlog but no workers left.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(poolWorkers, poolActiveWorkers, poolBoosts, poolShrinks, poolZeroWorkerRestarts)
+}
+
+// reapBoss watches q's pool and backlog depth for as long as q is alive. It
+// grows the pool when there's sustained backlog pressure, up to
+// maxWorkerCount, shrinks it back down after sustained low utilization
+// (never below one worker, so idle/active cycling can't pay the
+// zero-worker restart penalty below), and restarts it from zero if the
+// pool ever drops to no workers while work remains queued anyway -- see
+// Gitea PR #18658 for the bug this guards against.
+func (q *reapQueue) reapBoss(workerFunc func(*reapQueue, bool)) {
+	ticker := time.NewTicker(bossInterval)
+	defer ticker.Stop()
+
+	var highSince, lowSince time.Time
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats := q.PoolStats()
+
+		if stats.NumberOfWorkers == 0 {
+			highSince, lowSince = time.Time{}, time.Time{}
+			if stats.QueueDepth == 0 {
+				continue
+			}
+			q.logger.Infof("[reap] %p: boss restarting pool with 0 workers and %d queued", q, stats.QueueDepth)
+			poolZeroWorkerRestarts.Inc()
+			q.startWorker(workerFunc)
+			continue
+		}
+
+		depthPerWorker := stats.QueueDepth / stats.NumberOfWorkers
+		if depthPerWorker > depthPerWorkerThreshold {
+			lowSince = time.Time{}
+			if highSince.IsZero() {
+				highSince = time.Now()
+			} else if time.Since(highSince) > BoostTimeout && stats.NumberOfWorkers < q.maxWorkerCount {
+				q.logger.Infof("[reap] %p: boss boosting pool past %d workers", q, stats.NumberOfWorkers)
+				poolBoosts.Inc()
+				q.startWorker(workerFunc)
+				highSince = time.Time{}
+			}
+			continue
+		}
+		highSince = time.Time{}
+
+		if stats.NumberOfWorkers > 1 && stats.NumberOfActiveWorkers*2 < stats.NumberOfWorkers {
+			if lowSince.IsZero() {
+				lowSince = time.Now()
+			} else if time.Since(lowSince) > IdleTimeout {
+				q.logger.Infof("[reap] %p: boss shrinking pool of %d workers", q, stats.NumberOfWorkers)
+				poolShrinks.Inc()
+				q.poisonWorker()
+				lowSince = time.Time{}
+			}
+		} else {
+			lowSince = time.Time{}
+		}
+	}
+}
+
+// startWorker adds a worker to q's pool, claiming a token from controlCh
+// first so the pool never grows past maxWorkerCount.
+func (q *reapQueue) startWorker(workerFunc func(*reapQueue, bool)) {
+	select {
+	case q.controlCh <- workerToken{}:
+		q.wg.Add(1)
+		go workerFunc(q, true)
+	default:
+		// Pool is already at maxWorkerCount.
+	}
+}
+
+// poisonWorker asks exactly one idle worker to exit by handing it a poison
+// work item instead of real work. Callers must only invoke it when more
+// than one worker is running, so the pool is never poisoned down to zero.
+func (q *reapQueue) poisonWorker() {
+	select {
+	case q.workCh <- reapWorkItem{poison: true}:
+	case <-q.ctx.Done():
+	}
+}
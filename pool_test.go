@@ -0,0 +1,168 @@
+package autodelete
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeBossWorker mimics loadWorker/reapWorker's lifecycle closely enough to
+// drive reapBoss's grow/shrink decisions, without needing a *Bot or
+// *ManagedChannel: it registers itself as started/active, waits for a
+// poison item or shutdown, and tears itself down the same way.
+func fakeBossWorker(q *reapQueue, mayTimeout bool) {
+	q.workerStarted()
+	defer func() {
+		<-q.controlCh
+		q.workerStopped()
+		q.wg.Done()
+	}()
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case work := <-q.workCh:
+			if work.poison {
+				return
+			}
+		}
+	}
+}
+
+// spawnFakeBossWorker adds a worker driven by fakeBossWorker to q's pool,
+// claiming a controlCh token and wg slot the same way startWorker does.
+// Unlike spawnFakeWorker (queue_test.go), this worker actually reads
+// q.workCh, so it can be poisoned by the boss's shrink path.
+func spawnFakeBossWorker(q *reapQueue) {
+	q.controlCh <- workerToken{}
+	q.wg.Add(1)
+	go fakeBossWorker(q, true)
+}
+
+// withFastBossTimers temporarily shrinks the boss's timing knobs so tests
+// don't have to wait out the real 1s/5s/30s thresholds, and restores them
+// on cleanup. Callers must ensure their reapBoss goroutine has actually
+// exited before returning (see runReapBoss) -- otherwise it could still be
+// reading these package vars when cleanup rewrites them out from under it.
+func withFastBossTimers(t *testing.T, interval, boost, idle time.Duration) {
+	t.Helper()
+	origInterval, origBoost, origIdle := bossInterval, BoostTimeout, IdleTimeout
+	bossInterval, BoostTimeout, IdleTimeout = interval, boost, idle
+	t.Cleanup(func() {
+		bossInterval, BoostTimeout, IdleTimeout = origInterval, origBoost, origIdle
+	})
+}
+
+// runReapBoss starts q.reapBoss in its own goroutine and registers a defer
+// (run before withFastBossTimers's t.Cleanup restores the shared timer
+// vars) that cancels q and waits for reapBoss to actually return.
+func runReapBoss(t *testing.T, q *reapQueue) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.reapBoss(fakeBossWorker)
+	}()
+	t.Cleanup(func() {
+		q.cancel()
+		<-done
+	})
+}
+
+func TestReapBossRestartsFromZeroWorkers(t *testing.T) {
+	withFastBossTimers(t, 10*time.Millisecond, time.Hour, time.Hour)
+
+	q := newReapQueue(4)
+
+	if err := q.broker.Enqueue("ch1", time.Now()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	runReapBoss(t, q)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if q.PoolStats().NumberOfWorkers > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("boss never restarted the pool from zero workers despite queued work")
+}
+
+func TestReapBossBoostsUnderSustainedPressure(t *testing.T) {
+	withFastBossTimers(t, 5*time.Millisecond, 30*time.Millisecond, time.Hour)
+
+	q := newReapQueue(4)
+	spawnFakeBossWorker(q) // one worker, so NumberOfWorkers starts at 1
+
+	// depthPerWorkerThreshold is 4; queue 5 items so depth/worker (5/1) > 4.
+	for i := 0; i < 5; i++ {
+		if err := q.broker.Enqueue(string(rune('a'+i)), time.Now()); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	runReapBoss(t, q)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if q.PoolStats().NumberOfWorkers > 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("boss never boosted the pool despite sustained backlog pressure")
+}
+
+func TestReapBossDoesNotBoostPastMaxWorkerCount(t *testing.T) {
+	withFastBossTimers(t, 5*time.Millisecond, 20*time.Millisecond, time.Hour)
+
+	q := newReapQueue(1)
+	spawnFakeBossWorker(q) // already at maxWorkerCount
+
+	for i := 0; i < 5; i++ {
+		if err := q.broker.Enqueue(string(rune('a'+i)), time.Now()); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	runReapBoss(t, q)
+
+	// Give the boss several ticks to (not) act.
+	time.Sleep(200 * time.Millisecond)
+
+	if got := q.PoolStats().NumberOfWorkers; got != 1 {
+		t.Fatalf("NumberOfWorkers = %d, want 1 (maxWorkerCount)", got)
+	}
+}
+
+func TestReapBossShrinksButNeverBelowOneWorker(t *testing.T) {
+	withFastBossTimers(t, 5*time.Millisecond, time.Hour, 20*time.Millisecond)
+
+	q := newReapQueue(4)
+	spawnFakeBossWorker(q)
+	spawnFakeBossWorker(q)
+
+	runReapBoss(t, q)
+
+	// Both workers are idle (no active work), so the boss should shrink
+	// the pool from 2 down to 1 worker...
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if q.PoolStats().NumberOfWorkers == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := q.PoolStats().NumberOfWorkers; got != 1 {
+		t.Fatalf("NumberOfWorkers = %d, want 1 after shrinking", got)
+	}
+
+	// ...but never shrink the last one away, even after many more idle
+	// ticks past IdleTimeout.
+	time.Sleep(100 * time.Millisecond)
+	if got := q.PoolStats().NumberOfWorkers; got != 1 {
+		t.Fatalf("NumberOfWorkers = %d, want the boss to never shrink below 1", got)
+	}
+}
@@ -1,10 +1,8 @@
 package autodelete
 
 import (
-	"container/heap"
-	"fmt"
-	mrand "math/rand"
-	"strings"
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
@@ -14,139 +12,151 @@ const (
 	workerTimeout    = 5 * time.Second
 )
 
-// An Item is something we manage in a priority queue.
-type pqItem struct {
-	ch       *ManagedChannel
-	nextReap time.Time // The priority of the item in the queue.
-	// The index is needed by update and is maintained by the heap.Interface methods.
-	index int // The index of the item in the heap.
-}
-
-// A priorityQueue implements heap.Interface and holds Items.
-type priorityQueue []*pqItem
-
-func (pq priorityQueue) Len() int { return len(pq) }
-
-func (pq priorityQueue) Less(i, j int) bool {
-	// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-	return pq[i].nextReap.Before(pq[j].nextReap)
-}
-
-func (pq priorityQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-	pq[i].index = i
-	pq[j].index = j
-}
-
-func (pq *priorityQueue) Push(x interface{}) {
-	n := len(*pq)
-	item := x.(*pqItem)
-	item.index = n
-	*pq = append(*pq, item)
-}
-
-func (pq *priorityQueue) Pop() interface{} {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	item.index = -1 // for safety
-	*pq = old[0 : n-1]
-	return item
-}
-
-func (pq priorityQueue) Peek() *pqItem {
-	if len(pq) == 0 {
-		return nil
-	}
-	return pq[0]
-}
-
 type reapWorkItem struct {
 	ch   *ManagedChannel
 	msgs []string
+
+	// poison tells the receiving worker to exit instead of doing work,
+	// used by the boss goroutine to shrink the pool.
+	poison bool
 }
 
 type workerToken struct{}
 
 type reapQueue struct {
-	items  *priorityQueue
-	cond   *sync.Cond
-	timer  *time.Timer
+	// broker holds the actual reap schedule, in-process or otherwise; see
+	// newReapQueueWithBroker.
+	broker Broker
 	workCh chan reapWorkItem
 
 	// Send when a worker starts, receive when a worker quits
 	controlCh chan workerToken
 
 	curMu   sync.Mutex
-	curWork map[*ManagedChannel]struct{}
+	curWork map[string]*ManagedChannel
+
+	// channels resolves a broker's channel IDs back to the ManagedChannel
+	// Update was called with. For a memoryBroker this is always
+	// populated; a Broker that survives a restart (e.g. redisBroker)
+	// still needs the owning Bot to have reloaded and re-Update()d its
+	// channels before their IDs can come back out of Dequeue.
+	chMu     sync.Mutex
+	channels map[string]*ManagedChannel
+
+	// ctx is canceled by Shutdown, which unblocks WaitForNext, sendWorkItem,
+	// and any in-flight LoadBacklog/Reap call made with it.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	shutdownMu sync.Once
+	wg         sync.WaitGroup
+
+	// maxWorkerCount bounds how far the boss goroutine will grow the pool.
+	maxWorkerCount int
+
+	poolMu                sync.Mutex
+	numberOfWorkers       int
+	numberOfActiveWorkers int
+
+	// logger receives all of q's diagnostic output. Defaults to stdLogger;
+	// override with SetLogger.
+	logger Logger
 }
 
 func newReapQueue(maxWorkerCount int) *reapQueue {
-	var locker sync.Mutex
-	q := &reapQueue{
-		items:     new(priorityQueue),
-		cond:      sync.NewCond(&locker),
-		timer:     time.NewTimer(0),
-		workCh:    make(chan reapWorkItem),
-		controlCh: make(chan workerToken, maxWorkerCount),
-		curWork:   make(map[*ManagedChannel]struct{}),
+	return newReapQueueWithBroker(maxWorkerCount, newMemoryBroker())
+}
+
+// newReapQueueWithBroker is like newReapQueue but lets the caller supply a
+// Broker other than the default in-memory one, e.g. a redisBroker shared
+// across bot instances.
+func newReapQueueWithBroker(maxWorkerCount int, broker Broker) *reapQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &reapQueue{
+		broker:         broker,
+		workCh:         make(chan reapWorkItem),
+		controlCh:      make(chan workerToken, maxWorkerCount),
+		curWork:        make(map[string]*ManagedChannel),
+		channels:       make(map[string]*ManagedChannel),
+		ctx:            ctx,
+		cancel:         cancel,
+		maxWorkerCount: maxWorkerCount,
+		logger:         stdLogger{},
 	}
-	go func() {
-		// Signal the condition variable every time the timer expires.
-		for {
-			<-q.timer.C
-			q.cond.Signal()
+}
+
+// Shutdown stops the scheduler loop and all workers owned by q, canceling
+// any in-flight LoadBacklog/Reap call and waiting for active workers to
+// return. It waits until every worker has exited or ctx is done, whichever
+// comes first. Shutdown may be called more than once; only the first call
+// has effect.
+func (q *reapQueue) Shutdown(ctx context.Context) error {
+	q.shutdownMu.Do(func() {
+		q.cancel()
+		if closer, ok := q.broker.(brokerCloser); ok {
+			// Close in its own goroutine: it's not on the critical path
+			// to workers exiting, and a slow broker (e.g. a stalled
+			// Redis connection) shouldn't make Shutdown block past ctx's
+			// deadline below.
+			go func() {
+				if err := closer.Close(); err != nil {
+					q.logger.Errorf("[reap] %p: broker close failed: %v", q, err)
+				}
+			}()
 		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
 	}()
-	heap.Init(q.items)
-	return q
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// Update adds or inserts the expiry time for the given item in the queue.
+// Update schedules ch to become due at t, replacing any existing schedule
+// for it.
 func (q *reapQueue) Update(ch *ManagedChannel, t time.Time) {
-	q.cond.L.Lock()
-	defer q.cond.L.Unlock()
-
-	idx := -1
-	for i, v := range *q.items {
-		if v.ch == ch {
-			idx = i
-			break
-		}
-	}
-	if idx == -1 {
-		heap.Push(q.items, &pqItem{
-			ch:       ch,
-			nextReap: t,
-		})
-	} else {
-		(*q.items)[idx].nextReap = t
-		heap.Fix(q.items, idx)
+	q.chMu.Lock()
+	q.channels[ch.ChannelID] = ch
+	q.chMu.Unlock()
+
+	if err := q.broker.Enqueue(ch.ChannelID, t); err != nil {
+		q.logger.Errorf("[reap] %p: broker enqueue for %s failed: %v", q, ch, err)
 	}
-	q.cond.Signal()
 }
 
-func (q *reapQueue) WaitForNext() *ManagedChannel {
-	q.cond.L.Lock()
-start:
-	it := q.items.Peek()
-	if it == nil {
-		fmt.Println("[reap] waiting for insertion")
-		q.cond.Wait()
-		goto start
-	}
-	now := time.Now()
-	if it.nextReap.After(now) {
-		waitTime := it.nextReap.Sub(now)
-		fmt.Println("[reap] sleeping for ", waitTime-(waitTime%time.Second))
-		q.timer.Reset(waitTime + 2*time.Millisecond)
-		q.cond.Wait()
-		goto start
+// WaitForNext blocks until a channel is due for processing and claims it
+// from the broker, or until q is shut down, in which case ok is false.
+func (q *reapQueue) WaitForNext() (ch *ManagedChannel, ok bool) {
+	for {
+		chID, err := q.broker.Dequeue(q.ctx)
+		if err != nil {
+			return nil, false
+		}
+
+		q.chMu.Lock()
+		ch = q.channels[chID]
+		q.chMu.Unlock()
+
+		if ch == nil {
+			// Can happen after a restart against a broker that survives
+			// one (e.g. redisBroker) before the owning Bot has reloaded
+			// and re-Update()d this channel. Don't Ack it: that would
+			// discard the schedule entry for good. Leave it claimed so
+			// the broker's own stale-claim recovery (e.g. redisBroker's
+			// VisibilityTimeout sweep) puts it back on the schedule once
+			// the reload catches up.
+			q.logger.Warnf("[reap] %p: waiting on unknown channel %s claimed from broker", q, chID)
+			continue
+		}
+		return ch, true
 	}
-	x := heap.Pop(q.items)
-	q.cond.L.Unlock()
-	it = x.(*pqItem)
-	return it.ch
 }
 
 func (b *Bot) QueueReap(c *ManagedChannel) {
@@ -161,31 +171,55 @@ func (b *Bot) CancelReap(c *ManagedChannel) {
 	b.reaper.Update(c, zeroTime)
 }
 
-func (b *Bot) QueueLoadBacklog(c *ManagedChannel, didFail bool) {
-	c.mu.Lock()
-	loadDelay := c.loadFailures
-	if didFail {
-		c.loadFailures = time.Duration(int64(loadDelay)*2 + int64(mrand.Intn(int(5*time.Second))))
-		loadDelay = c.loadFailures
-	}
-	c.mu.Unlock()
+// QueueLoadBacklog schedules c's backlog to be (re)loaded after delay. Pass
+// 0 to load as soon as a worker is free.
+func (b *Bot) QueueLoadBacklog(c *ManagedChannel, delay time.Duration) {
+	b.loadRetries.Update(c, time.Now().Add(delay))
+}
 
-	b.loadRetries.Update(c, time.Now().Add(loadDelay))
+// Shutdown cancels any in-flight reap/backlog-load work and waits for both
+// the reap and backlog-load queues to drain, or until ctx expires.
+func (b *Bot) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = b.reaper.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = b.loadRetries.Shutdown(ctx)
+	}()
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func reapScheduler(q *reapQueue, workerFunc func(*reapQueue, bool)) {
 	q.controlCh <- workerToken{}
+	q.wg.Add(1)
 	go workerFunc(q, false)
+	go q.reapBoss(workerFunc)
 
 	timer := time.NewTimer(0)
 
 	for {
-		ch := q.WaitForNext()
+		ch, ok := q.WaitForNext()
+		if !ok {
+			return
+		}
 
 		q.curMu.Lock()
-		_, channelAlreadyBeingProcessed := q.curWork[ch]
+		_, channelAlreadyBeingProcessed := q.curWork[ch.ChannelID]
 		if !channelAlreadyBeingProcessed {
-			q.curWork[ch] = struct{}{}
+			q.curWork[ch.ChannelID] = ch
 		}
 		q.curMu.Unlock()
 
@@ -193,11 +227,12 @@ func reapScheduler(q *reapQueue, workerFunc func(*reapQueue, bool)) {
 			continue
 		}
 
-		sendWorkItem(q, workerFunc, timer, reapWorkItem{ch: ch})
+		sendWorkItem(q, timer, reapWorkItem{ch: ch})
 	}
 }
 
-func sendWorkItem(q *reapQueue, workerFunc func(*reapQueue, bool), timer *time.Timer, work reapWorkItem) {
+func sendWorkItem(q *reapQueue, timer *time.Timer, work reapWorkItem) {
+	warned := false
 	for {
 		if !timer.Stop() {
 			<-timer.C
@@ -206,29 +241,36 @@ func sendWorkItem(q *reapQueue, workerFunc func(*reapQueue, bool), timer *time.T
 		select {
 		case q.workCh <- work:
 			return
+		case <-q.ctx.Done():
+			return
 		case <-timer.C:
-			// Attempt to start a new worker, or block if we can't
-			select {
-			case q.controlCh <- workerToken{}:
-				fmt.Printf("[reap] %p: starting new worker\n", q)
-				go workerFunc(q, true)
-				continue
-			case q.workCh <- work:
-				return
+			// No free worker within schedulerTimeout; keep waiting for
+			// one. Growing the pool is the boss goroutine's job, which
+			// only does so under sustained pressure -- see reapBoss. Warn
+			// once per stall instead of every schedulerTimeout so sustained
+			// pressure doesn't flood the log.
+			if !warned {
+				q.logger.Warnf("[reap] %p: no free worker after %s, still waiting", q, schedulerTimeout)
+				warned = true
 			}
+			// timer.C has just been drained, so re-arm the timer here;
+			// otherwise the Stop/drain at the top of the loop would block
+			// forever on an empty channel.
+			timer.Reset(schedulerTimeout)
 		}
 	}
 }
 
 func (b *Bot) loadWorker(q *reapQueue, mayTimeout bool) {
-	timer := time.NewTimer(0)
+	q.workerStarted()
+	defer func() {
+		<-q.controlCh // remove a worker token
+		q.workerStopped()
+		q.wg.Done()
+		q.logger.Infof("[reap] %p: worker exiting", q)
+	}()
 
-	if mayTimeout {
-		defer func() {
-			<-q.controlCh // remove a worker token
-			fmt.Printf("[reap] %p: worker exiting\n", q)
-		}()
-	}
+	timer := time.NewTimer(0)
 
 	for {
 		if mayTimeout {
@@ -239,65 +281,142 @@ func (b *Bot) loadWorker(q *reapQueue, mayTimeout bool) {
 		}
 
 		select {
-		case <-timer.C:
+		case <-q.ctx.Done():
 			return
+		case <-timer.C:
+			if mayTimeout {
+				return
+			}
 		case work := <-q.workCh:
+			if work.poison {
+				return
+			}
 			ch := work.ch
 			if ch.IsDisabled() {
 				continue
 			}
+			if b.rateLimitWait(q, ch) {
+				continue
+			}
 
-			err := ch.LoadBacklog()
+			q.workerActive()
+			err := b.withPanicRecovery(q, ch, "load", func() error {
+				return ch.LoadBacklog(q.ctx)
+			})
+			q.workerIdle()
 
 			q.curMu.Lock()
-			delete(q.curWork, ch)
+			delete(q.curWork, ch.ChannelID)
 			q.curMu.Unlock()
-
-			if isRetryableLoadError(err) {
-				b.QueueLoadBacklog(ch, true)
+			q.broker.Ack(ch.ChannelID)
+
+			var panicErr *workerPanicError
+			switch {
+			case errors.As(err, &panicErr):
+				count := b.registerLoadFailure(q, ch)
+				b.QueueLoadBacklog(ch, loadFailureBackoff(count))
+			case err != nil:
+				decision := classifyLoadError(err)
+				b.registerLoadFailure(q, ch)
+				if decision.retry {
+					b.QueueLoadBacklog(ch, decision.after)
+				} else {
+					b.handleWorkerError(ch, err, "load")
+				}
+			default:
+				b.registerLoadSuccess(ch)
 			}
 		}
 	}
 }
 
 func (b *Bot) reapWorker(q *reapQueue, mayTimeout bool) {
-	// TODO: implement mayTimeout
-	for work := range q.workCh {
-		ch := work.ch
-		msgs, shouldQueueBacklog, isDisabled := ch.collectMessagesToDelete()
-		if isDisabled {
-			continue // drop ch
-		}
+	q.workerStarted()
+	defer func() {
+		<-q.controlCh // remove a worker token
+		q.workerStopped()
+		q.wg.Done()
+		q.logger.Infof("[reap] %p: worker exiting", q)
+	}()
 
-		fmt.Printf("[reap] %s: deleting %d messages\n", ch, len(msgs))
-		count, err := ch.Reap(msgs)
-		if b.handleCriticalPermissionsErrors(ch.ChannelID, err) {
-			continue // drop ch
-		}
-		if err != nil {
-			fmt.Printf("[reap] %s: deleted %d, got error: %v\n", ch, count, err)
-			shouldQueueBacklog = true
-		} else if count == -1 {
-			fmt.Printf("[reap] %s: doing single-message delete\n", ch)
+	timer := time.NewTimer(0)
+
+	for {
+		if mayTimeout {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(workerTimeout)
 		}
 
-		q.curMu.Lock()
-		delete(q.curWork, ch)
-		q.curMu.Unlock()
-		b.QueueReap(ch)
-		if shouldQueueBacklog {
-			b.QueueLoadBacklog(ch /* didFail= */, true) // add extra delay
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-timer.C:
+			if mayTimeout {
+				return
+			}
+		case work := <-q.workCh:
+			if work.poison {
+				return
+			}
+			ch := work.ch
+			if b.rateLimitWait(q, ch) {
+				continue
+			}
+
+			q.workerActive()
+			shouldQueueBacklog, dropped, err := b.reapOne(q, ch)
+			q.workerIdle()
+
+			q.curMu.Lock()
+			delete(q.curWork, ch.ChannelID)
+			q.curMu.Unlock()
+			q.broker.Ack(ch.ChannelID)
+
+			var panicErr *workerPanicError
+			switch {
+			case errors.As(err, &panicErr):
+				count := b.registerLoadFailure(q, ch)
+				b.QueueReap(ch)
+				b.QueueLoadBacklog(ch, loadFailureBackoff(count))
+			case dropped:
+				// ch was disabled or hit a critical permissions error.
+			default:
+				b.QueueReap(ch)
+				if shouldQueueBacklog {
+					b.QueueLoadBacklog(ch, fullJitter(30*time.Second)) // add extra delay
+				}
+			}
 		}
 	}
 }
 
-func isRetryableLoadError(err error) bool {
-	if err == nil {
-		return false
-	}
-	// Only error to retry is a CloudFlare HTML 429
-	if strings.Contains(err.Error(), "rate limit unmarshal error") {
-		return true
-	}
-	return false
+// reapOne collects and deletes ch's due messages, recovering from any
+// panic so a single malformed channel can't crash the worker pool.
+func (b *Bot) reapOne(q *reapQueue, ch *ManagedChannel) (shouldQueueBacklog, dropped bool, err error) {
+	err = b.withPanicRecovery(q, ch, "reap", func() error {
+		msgs, queueBacklog, isDisabled := ch.collectMessagesToDelete()
+		if isDisabled {
+			dropped = true
+			return nil
+		}
+		shouldQueueBacklog = queueBacklog
+
+		q.logger.Infof("[reap] %s: deleting %d messages", ch, len(msgs))
+		count, reapErr := ch.Reap(q.ctx, msgs)
+		if b.handleCriticalPermissionsErrors(ch.ChannelID, reapErr) {
+			dropped = true
+			return nil
+		}
+		if reapErr != nil {
+			q.logger.Warnf("[reap] %s: deleted %d, got error: %v", ch, count, reapErr)
+			shouldQueueBacklog = true
+			b.handleWorkerError(ch, reapErr, "reap")
+		} else if count == -1 {
+			q.logger.Infof("[reap] %s: doing single-message delete", ch)
+		}
+		return nil
+	})
+	return shouldQueueBacklog, dropped, err
 }
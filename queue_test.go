@@ -0,0 +1,132 @@
+package autodelete
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// spawnFakeWorker mimics loadWorker/reapWorker's lifecycle (wg.Add before
+// the goroutine starts, workerStarted/workerStopped bracketing it, and
+// wg.Done on exit) without needing a *Bot or *ManagedChannel, so it can
+// exercise reapQueue.Shutdown the way a real worker pool would.
+func spawnFakeWorker(q *reapQueue) {
+	q.controlCh <- workerToken{}
+	q.wg.Add(1)
+	go func() {
+		q.workerStarted()
+		defer func() {
+			<-q.controlCh
+			q.workerStopped()
+			q.wg.Done()
+		}()
+		<-q.ctx.Done()
+	}()
+}
+
+func TestReapQueueShutdownWaitsForLiveWorkers(t *testing.T) {
+	q := newReapQueue(4)
+	for i := 0; i < 4; i++ {
+		spawnFakeWorker(q)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	stats := q.PoolStats()
+	if stats.NumberOfWorkers != 0 {
+		t.Fatalf("NumberOfWorkers after Shutdown = %d, want 0", stats.NumberOfWorkers)
+	}
+}
+
+func TestReapQueueShutdownIsIdempotent(t *testing.T) {
+	q := newReapQueue(2)
+	spawnFakeWorker(q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("first Shutdown: %v", err)
+	}
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+}
+
+func TestReapQueueShutdownReturnsCtxErrIfWorkerHangs(t *testing.T) {
+	q := newReapQueue(1)
+
+	// A worker that never notices q.ctx being canceled -- Shutdown must
+	// give up once its own ctx expires instead of blocking forever.
+	q.controlCh <- workerToken{}
+	q.wg.Add(1)
+	blockForever := make(chan struct{})
+	defer close(blockForever)
+	go func() {
+		defer q.wg.Done()
+		<-blockForever
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := q.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestWaitForNextUnknownChannelIsNotLost exercises chunk0-6's fix inside
+// WaitForNext: a chID claimed from the broker before the owning Bot has
+// re-Update()d it must not be Acked away, or it would be gone for good
+// instead of merely delayed.
+func TestWaitForNextUnknownChannelIsNotLost(t *testing.T) {
+	q := newReapQueue(1)
+
+	if err := q.broker.Enqueue("unregistered", time.Now()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// WaitForNext loops internally on an unknown chID rather than
+		// returning, so drive it from its own goroutine and observe the
+		// broker state from here instead of expecting it to return.
+		q.WaitForNext()
+		close(done)
+	}()
+
+	// Give WaitForNext time to claim "unregistered", skip it (since it's
+	// never Update()d in this test), and go back to blocking in Dequeue.
+	time.Sleep(50 * time.Millisecond)
+
+	snap, err := q.broker.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if _, ok := snap["unregistered"]; ok {
+		t.Fatal("unregistered chID is back on the schedule already; test setup is wrong")
+	}
+
+	mb, ok := q.broker.(*memoryBroker)
+	if !ok {
+		t.Fatalf("broker is %T, want *memoryBroker", q.broker)
+	}
+	mb.mu.Lock()
+	_, stillClaimed := mb.processing["unregistered"]
+	mb.mu.Unlock()
+	if !stillClaimed {
+		t.Fatal("unregistered chID was Acked (and so discarded) instead of left claimed")
+	}
+
+	q.cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WaitForNext goroutine did not exit after q.cancel()")
+	}
+}
@@ -0,0 +1,173 @@
+package autodelete
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// guildRateLimiterConfig controls the token buckets handed out by a
+// guildRateLimiter.
+type guildRateLimiterConfig struct {
+	// RPS and Burst bound how often a single guild's channels may be
+	// reaped or have their backlog loaded.
+	RPS   rate.Limit
+	Burst int
+
+	// GlobalRPS and GlobalBurst bound the combined rate across every
+	// guild, as a backstop against Discord's global rate limit.
+	GlobalRPS   rate.Limit
+	GlobalBurst int
+
+	// RescheduleThreshold is the longest a worker will block waiting on
+	// a guild's bucket before giving up and asking the scheduler to
+	// re-queue the item instead.
+	RescheduleThreshold time.Duration
+}
+
+var defaultGuildRateLimiterConfig = guildRateLimiterConfig{
+	RPS:                 rate.Limit(1),
+	Burst:               5,
+	GlobalRPS:           rate.Limit(50),
+	GlobalBurst:         100,
+	RescheduleThreshold: 2 * time.Second,
+}
+
+// rescheduleError is returned by guildRateLimiter.Wait when admitting the
+// request would take longer than RescheduleThreshold. After holds how long
+// the caller should wait before retrying.
+type rescheduleError struct {
+	after time.Duration
+}
+
+func (e *rescheduleError) Error() string {
+	return fmt.Sprintf("rate limit wait of %s exceeds reschedule threshold", e.after)
+}
+
+// guildRateLimiter hands out a token bucket per Discord guild, backstopped
+// by a single global bucket, so a burst of channels in one guild can't
+// starve reap/backlog-load work for other guilds or blow through Discord's
+// global rate limit.
+type guildRateLimiter struct {
+	cfg    guildRateLimiterConfig
+	global *rate.Limiter
+
+	mu       sync.Mutex
+	perGuild map[string]*rate.Limiter
+}
+
+func newGuildRateLimiter(cfg guildRateLimiterConfig) *guildRateLimiter {
+	return &guildRateLimiter{
+		cfg:      cfg,
+		global:   rate.NewLimiter(cfg.GlobalRPS, cfg.GlobalBurst),
+		perGuild: make(map[string]*rate.Limiter),
+	}
+}
+
+func (l *guildRateLimiter) limiterFor(guildID string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.perGuild[guildID]
+	if !ok {
+		lim = rate.NewLimiter(l.cfg.RPS, l.cfg.Burst)
+		l.perGuild[guildID] = lim
+	}
+	return lim
+}
+
+// Wait blocks until guildID's bucket and the global bucket both admit one
+// more request, or ctx is done. If the wait would exceed
+// RescheduleThreshold it reserves nothing and returns a *rescheduleError
+// instead, so the caller can re-queue the work rather than pinning a
+// worker on it.
+func (l *guildRateLimiter) Wait(ctx context.Context, guildID string) error {
+	now := time.Now()
+
+	guildRes := l.limiterFor(guildID).ReserveN(now, 1)
+	if !guildRes.OK() {
+		return fmt.Errorf("rate limit: guild %s burst exceeded", guildID)
+	}
+	globalRes := l.global.ReserveN(now, 1)
+	if !globalRes.OK() {
+		guildRes.Cancel()
+		return fmt.Errorf("rate limit: global burst exceeded")
+	}
+
+	delay := guildRes.DelayFrom(now)
+	if d := globalRes.DelayFrom(now); d > delay {
+		delay = d
+	}
+
+	if delay > l.cfg.RescheduleThreshold {
+		guildRes.Cancel()
+		globalRes.Cancel()
+		rateLimitReschedules.Inc()
+		return &rescheduleError{after: delay}
+	}
+	if delay == 0 {
+		return nil
+	}
+
+	rateLimitWaits.Inc()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		guildRes.Cancel()
+		globalRes.Cancel()
+		return ctx.Err()
+	}
+}
+
+var (
+	rateLimitWaits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "rate_limit_waits_total",
+		Help:      "Number of times a worker blocked on the per-guild rate limiter before making a Discord API call.",
+	})
+	rateLimitReschedules = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "autodelete",
+		Subsystem: "reaper",
+		Name:      "rate_limit_reschedules_total",
+		Help:      "Number of times a work item was re-queued instead of waiting on the per-guild rate limiter.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitWaits, rateLimitReschedules)
+}
+
+// rateLimitWait blocks the calling worker until it's safe to make a Discord
+// API call on ch's guild. If that would take longer than the limiter's
+// RescheduleThreshold, ch is instead re-queued on q for the delayed time.
+// It reports whether the caller should skip ch and move on to other work,
+// which is also true when q is shutting down.
+func (b *Bot) rateLimitWait(q *reapQueue, ch *ManagedChannel) (skip bool) {
+	err := b.limiter.Wait(q.ctx, ch.GuildID)
+	if err == nil {
+		return false
+	}
+
+	q.curMu.Lock()
+	delete(q.curWork, ch.ChannelID)
+	q.curMu.Unlock()
+	q.broker.Ack(ch.ChannelID)
+
+	if resched, ok := err.(*rescheduleError); ok {
+		q.Update(ch, time.Now().Add(resched.after))
+	} else {
+		// q.ctx was canceled (e.g. by Shutdown) while we were waiting on
+		// the rate limiter. ch was already popped off the broker's
+		// schedule by Dequeue, so Ack-ing it without re-enqueueing would
+		// discard its schedule for good instead of merely delaying it.
+		q.Update(ch, time.Now())
+	}
+	return true
+}
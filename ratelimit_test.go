@@ -0,0 +1,140 @@
+package autodelete
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestGuildRateLimiterAdmitsWithinBurst(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(1),
+		Burst:               2,
+		GlobalRPS:           rate.Limit(100),
+		GlobalBurst:         100,
+		RescheduleThreshold: time.Second,
+	})
+
+	if err := l.Wait(context.Background(), "guild-a"); err != nil {
+		t.Fatalf("first call within burst: %v", err)
+	}
+	if err := l.Wait(context.Background(), "guild-a"); err != nil {
+		t.Fatalf("second call within burst: %v", err)
+	}
+}
+
+func TestGuildRateLimiterReschedulesPastThreshold(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(1),
+		Burst:               1,
+		GlobalRPS:           rate.Limit(100),
+		GlobalBurst:         100,
+		RescheduleThreshold: 10 * time.Millisecond,
+	})
+
+	ctx := context.Background()
+	if err := l.Wait(ctx, "guild-a"); err != nil {
+		t.Fatalf("first call should consume the burst token: %v", err)
+	}
+
+	err := l.Wait(ctx, "guild-a")
+	var resched *rescheduleError
+	if !errors.As(err, &resched) {
+		t.Fatalf("second call = %v, want a *rescheduleError", err)
+	}
+	if resched.after <= 0 {
+		t.Fatalf("resched.after = %v, want > 0", resched.after)
+	}
+}
+
+func TestGuildRateLimiterPerGuildIsolation(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(1),
+		Burst:               1,
+		GlobalRPS:           rate.Limit(100),
+		GlobalBurst:         100,
+		RescheduleThreshold: 10 * time.Millisecond,
+	})
+
+	ctx := context.Background()
+	if err := l.Wait(ctx, "guild-a"); err != nil {
+		t.Fatalf("guild-a first call: %v", err)
+	}
+
+	// guild-a is now past its burst, but guild-b has its own bucket.
+	if err := l.Wait(ctx, "guild-b"); err != nil {
+		t.Fatalf("guild-b call should admit on its own bucket: %v", err)
+	}
+
+	var resched *rescheduleError
+	if err := l.Wait(ctx, "guild-a"); !errors.As(err, &resched) {
+		t.Fatalf("guild-a second call = %v, want a *rescheduleError", err)
+	}
+}
+
+func TestGuildRateLimiterGlobalBurstBackstopsAllGuilds(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(100),
+		Burst:               100,
+		GlobalRPS:           rate.Limit(1),
+		GlobalBurst:         1,
+		RescheduleThreshold: 10 * time.Millisecond,
+	})
+
+	ctx := context.Background()
+	if err := l.Wait(ctx, "guild-a"); err != nil {
+		t.Fatalf("first call should consume the global burst token: %v", err)
+	}
+
+	var resched *rescheduleError
+	if err := l.Wait(ctx, "guild-b"); !errors.As(err, &resched) {
+		t.Fatalf("guild-b call = %v, want the exhausted global bucket to reschedule it", err)
+	}
+}
+
+func TestGuildRateLimiterWaitBlocksUnderThreshold(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(20),
+		Burst:               1,
+		GlobalRPS:           rate.Limit(100),
+		GlobalBurst:         100,
+		RescheduleThreshold: time.Second,
+	})
+
+	ctx := context.Background()
+	if err := l.Wait(ctx, "guild-a"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+
+	start := time.Now()
+	if err := l.Wait(ctx, "guild-a"); err != nil {
+		t.Fatalf("second call should block and then admit: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("second call returned after %v, want it to have waited for a token", elapsed)
+	}
+}
+
+func TestGuildRateLimiterWaitRespectsContextCancellation(t *testing.T) {
+	l := newGuildRateLimiter(guildRateLimiterConfig{
+		RPS:                 rate.Limit(1),
+		Burst:               1,
+		GlobalRPS:           rate.Limit(100),
+		GlobalBurst:         100,
+		RescheduleThreshold: time.Minute,
+	})
+
+	if err := l.Wait(context.Background(), "guild-a"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(ctx, "guild-a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second call = %v, want context.DeadlineExceeded", err)
+	}
+}
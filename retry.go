@@ -0,0 +1,150 @@
+package autodelete
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxLoadRetryDelay bounds the backoff classifyLoadError computes,
+	// regardless of what Discord's headers say.
+	maxLoadRetryDelay = 10 * time.Minute
+
+	// maxConsecutiveLoadFailures is how many consecutive failures a
+	// channel may accumulate before it's disabled, the same way a critical
+	// permissions error would disable it. Every failed backlog load counts,
+	// retryable or not, as does a worker panic.
+	maxConsecutiveLoadFailures = 10
+)
+
+// retryDecision is the result of classifying a LoadBacklog error: whether
+// it's worth retrying and, if so, how long to wait first.
+type retryDecision struct {
+	retry bool
+	after time.Duration
+}
+
+// classifyLoadError replaces the old isRetryableLoadError string match. It
+// inspects a *discordgo.RESTError's status code and rate-limit headers, a
+// CloudFlare HTML 429 body discordgo failed to parse, or any other
+// (presumed network) error, and decides whether LoadBacklog is worth
+// retrying and after how long.
+func classifyLoadError(err error) retryDecision {
+	if err == nil {
+		return retryDecision{}
+	}
+
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		switch {
+		case restErr.Response.StatusCode == http.StatusTooManyRequests:
+			after := retryAfter(restErr.Response.Header)
+			if after > maxLoadRetryDelay {
+				after = maxLoadRetryDelay
+			}
+			return retryDecision{retry: true, after: after}
+		case restErr.Response.StatusCode >= 500:
+			return retryDecision{retry: true, after: fullJitter(30 * time.Second)}
+		default:
+			// 4xx other than 429 (missing access, unknown channel, ...)
+			// is terminal; retrying won't help.
+			return retryDecision{}
+		}
+	}
+
+	if strings.Contains(err.Error(), "rate limit unmarshal error") {
+		// A CloudFlare HTML 429 page that discordgo couldn't parse as
+		// JSON. Discord gives us no Retry-After for these, so fall back
+		// to full jitter against the max delay.
+		return retryDecision{retry: true, after: fullJitter(maxLoadRetryDelay)}
+	}
+
+	// Network errors, timeouts, and the like are presumed transient.
+	return retryDecision{retry: true, after: fullJitter(30 * time.Second)}
+}
+
+// retryAfter reads Discord's Retry-After or X-RateLimit-Reset-After
+// headers, falling back to jitter if neither is present or parseable.
+func retryAfter(h http.Header) time.Duration {
+	for _, key := range []string{"Retry-After", "X-RateLimit-Reset-After"} {
+		v := h.Get(key)
+		if v == "" {
+			continue
+		}
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			return time.Duration(secs * float64(time.Second))
+		}
+	}
+	return fullJitter(30 * time.Second)
+}
+
+// fullJitter returns a random duration in [0, max), as in asynq's
+// retryDelayFunc, so a batch of failing channels doesn't retry in lockstep.
+func fullJitter(max time.Duration) time.Duration {
+	if max > maxLoadRetryDelay {
+		max = maxLoadRetryDelay
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// registerLoadFailure bumps ch's consecutive backlog-load failure count
+// and, once it trips maxConsecutiveLoadFailures, disables ch the same way
+// handleCriticalPermissionsErrors would -- a channel that can never load
+// its backlog is as unusable as one we lack permissions in. It returns the
+// updated count so callers can scale their retry backoff to it.
+func (b *Bot) registerLoadFailure(q *reapQueue, ch *ManagedChannel) int {
+	ch.mu.Lock()
+	ch.loadFailureCount++
+	count := ch.loadFailureCount
+	ch.mu.Unlock()
+
+	if count < maxConsecutiveLoadFailures {
+		return count
+	}
+
+	err := fmt.Errorf("disabled after %d consecutive backlog-load failures", count)
+	q.logger.Errorf("[reap] %s: %v", ch, err)
+	ch.Disable()
+	b.handleWorkerError(ch, err, "load")
+	return count
+}
+
+// loadFailureBackoff doubles a 30s base delay for every consecutive
+// load failure ch has accumulated, capped at maxLoadRetryDelay and
+// jittered the same way classifyLoadError's retryable delays are, so a
+// channel that keeps failing (or keeps panicking) backs off instead of
+// retrying every 0-30s forever.
+func loadFailureBackoff(count int) time.Duration {
+	base := 30 * time.Second
+	if count < 1 {
+		count = 1
+	}
+	if count > 32 {
+		// Avoid overflowing the shift; anything this high already
+		// saturates maxLoadRetryDelay below.
+		return fullJitter(maxLoadRetryDelay)
+	}
+	backoff := base << uint(count-1)
+	if backoff <= 0 || backoff > maxLoadRetryDelay {
+		backoff = maxLoadRetryDelay
+	}
+	return fullJitter(backoff)
+}
+
+// registerLoadSuccess clears ch's consecutive-failure count after a
+// successful backlog load.
+func (b *Bot) registerLoadSuccess(ch *ManagedChannel) {
+	ch.mu.Lock()
+	ch.loadFailureCount = 0
+	ch.mu.Unlock()
+}
@@ -0,0 +1,151 @@
+package autodelete
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestClassifyLoadErrorNil(t *testing.T) {
+	d := classifyLoadError(nil)
+	if d.retry {
+		t.Fatalf("classifyLoadError(nil) = %+v, want a non-retryable zero value", d)
+	}
+}
+
+func TestClassifyLoadErrorTooManyRequests(t *testing.T) {
+	err := &discordgo.RESTError{
+		Response: &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"2.5"}},
+		},
+	}
+
+	d := classifyLoadError(err)
+	if !d.retry {
+		t.Fatalf("classifyLoadError(429) = %+v, want retry", d)
+	}
+	if d.after != 2500*time.Millisecond {
+		t.Fatalf("after = %v, want 2.5s from Retry-After", d.after)
+	}
+}
+
+func TestClassifyLoadErrorServerError(t *testing.T) {
+	err := &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusInternalServerError},
+	}
+
+	d := classifyLoadError(err)
+	if !d.retry {
+		t.Fatalf("classifyLoadError(500) = %+v, want retry", d)
+	}
+	if d.after < 0 || d.after >= 30*time.Second {
+		t.Fatalf("after = %v, want a jittered delay under 30s", d.after)
+	}
+}
+
+func TestClassifyLoadErrorTerminalStatus(t *testing.T) {
+	err := &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusForbidden},
+	}
+
+	d := classifyLoadError(err)
+	if d.retry {
+		t.Fatalf("classifyLoadError(403) = %+v, want non-retryable", d)
+	}
+}
+
+func TestClassifyLoadErrorCloudFlareUnmarshal(t *testing.T) {
+	err := errors.New("rate limit unmarshal error, unable to decode response")
+
+	d := classifyLoadError(err)
+	if !d.retry {
+		t.Fatalf("classifyLoadError(cloudflare 429) = %+v, want retry", d)
+	}
+	if d.after < 0 || d.after >= maxLoadRetryDelay {
+		t.Fatalf("after = %v, want a jittered delay under maxLoadRetryDelay", d.after)
+	}
+}
+
+func TestClassifyLoadErrorNetworkError(t *testing.T) {
+	err := errors.New("dial tcp: connection refused")
+
+	d := classifyLoadError(err)
+	if !d.retry {
+		t.Fatalf("classifyLoadError(network error) = %+v, want retry", d)
+	}
+	if d.after < 0 || d.after >= 30*time.Second {
+		t.Fatalf("after = %v, want a jittered delay under 30s", d.after)
+	}
+}
+
+func TestRetryAfterPrefersRetryAfterHeader(t *testing.T) {
+	h := http.Header{
+		"Retry-After":             []string{"1"},
+		"X-RateLimit-Reset-After": []string{"99"},
+	}
+	if got := retryAfter(h); got != time.Second {
+		t.Fatalf("retryAfter() = %v, want 1s from Retry-After", got)
+	}
+}
+
+func TestRetryAfterFallsBackToRateLimitReset(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-RateLimit-Reset-After", "0.25")
+	if got := retryAfter(h); got != 250*time.Millisecond {
+		t.Fatalf("retryAfter() = %v, want 250ms from X-RateLimit-Reset-After", got)
+	}
+}
+
+func TestRetryAfterFallsBackToJitterWhenHeadersMissing(t *testing.T) {
+	got := retryAfter(http.Header{})
+	if got < 0 || got >= 30*time.Second {
+		t.Fatalf("retryAfter() = %v, want a jittered delay under 30s", got)
+	}
+}
+
+func TestFullJitterBounds(t *testing.T) {
+	if got := fullJitter(0); got != 0 {
+		t.Fatalf("fullJitter(0) = %v, want 0", got)
+	}
+	if got := fullJitter(-time.Second); got != 0 {
+		t.Fatalf("fullJitter(negative) = %v, want 0", got)
+	}
+
+	for i := 0; i < 100; i++ {
+		got := fullJitter(10 * time.Second)
+		if got < 0 || got >= 10*time.Second {
+			t.Fatalf("fullJitter(10s) = %v, out of [0, 10s)", got)
+		}
+	}
+}
+
+func TestFullJitterClampsToMaxLoadRetryDelay(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		got := fullJitter(maxLoadRetryDelay * 10)
+		if got >= maxLoadRetryDelay {
+			t.Fatalf("fullJitter(huge) = %v, want < maxLoadRetryDelay", got)
+		}
+	}
+}
+
+func TestLoadFailureBackoffDoublesAndCaps(t *testing.T) {
+	for count := 1; count <= 6; count++ {
+		// fullJitter is random, so check against the ceiling each count
+		// implies rather than the exact value.
+		ceiling := 30 * time.Second << uint(count-1)
+		for i := 0; i < 20; i++ {
+			got := loadFailureBackoff(count)
+			if got < 0 || got >= ceiling {
+				t.Fatalf("loadFailureBackoff(%d) = %v, want < %v", count, got, ceiling)
+			}
+		}
+	}
+
+	if got := loadFailureBackoff(100); got >= maxLoadRetryDelay {
+		t.Fatalf("loadFailureBackoff(100) = %v, want < maxLoadRetryDelay", got)
+	}
+}